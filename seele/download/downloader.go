@@ -25,14 +25,37 @@ const (
 	GetBlocksMsg       uint16 = 10
 	BlocksPreMsg       uint16 = 11 // is sent before BlockMsg, containing block numbers of BlockMsg.
 	BlocksMsg          uint16 = 12
+	GetStateDataMsg    uint16 = 13 // requests the trie nodes for a set of state hashes
+	StateDataMsg       uint16 = 14 // carries the trie nodes requested by GetStateDataMsg
+)
+
+// SyncMode tells Synchronise how much of the chain to fetch.
+type SyncMode int
+
+const (
+	// FullSync downloads and executes every block from genesis (or the
+	// local chain head) up to the peer's head.
+	FullSync SyncMode = iota
+
+	// FastSync downloads every header up to the peer's head, then pulls
+	// down the full world state for a recent "pivot" block instead of
+	// re-executing the whole history, and executes normally from there.
+	FastSync
 )
 
 var (
 	MaxBlockFetch  = 128 // Amount of blocks to be fetched per retrieval request
 	MaxHeaderFetch = 256 // Amount of block headers to be fetched per retrieval request
+	MaxStateFetch  = 384 // Amount of trie nodes to be fetched per retrieval request
+
+	minBlockFetch  = 8  // Floor a slow peer's block request is never scaled below
+	minHeaderFetch = 16 // Floor a slow peer's header request is never scaled below
 
 	MaxForkAncestry = 90000       // Maximum chain reorganisation
 	peerIdleTime    = time.Second // peer's wait time for next turn if no task now
+	waitMsgTimeout  = time.Minute // how long a peer has to answer an outstanding request
+
+	fastSyncPivotDistance = uint64(64) // how far behind the peer's head the pivot block sits
 
 	MaxMessageLength = 8 * 1024 * 1024
 	statusNone       = 1 // no sync session
@@ -49,6 +72,8 @@ var (
 	errMaxForkAncestor     = errors.New("Can not find ancestor when reached MaxForkAncestry")
 	errPeerNotFound        = errors.New("Peer not found")
 	errSyncErr             = errors.New("Err occurs when syncing")
+	errNoPivotBlock        = errors.New("Can not pick a pivot block for fast sync")
+	errCheckpointMismatch  = errors.New("Peer header does not match trusted checkpoint")
 )
 
 // Downloader sync block chain with remote peer
@@ -58,7 +83,17 @@ type Downloader struct {
 	peers      map[string]*peerConn // peers map. peerID=>peer
 
 	syncStatus int
+	syncMode   SyncMode
 	tm         *taskMgr
+	ss         *stateSync
+
+	// requiredBlocks are heights whose hash is pinned by the operator (via
+	// SetRequiredBlocks). A candidate master peer must agree on every one
+	// of them that falls at or below its advertised head before it is
+	// trusted, giving an anti-eclipse guarantee independent of TD.
+	requiredBlocks map[uint64]common.Hash
+
+	progress SyncProgress
 
 	chain     *core.Blockchain
 	sessionWG sync.WaitGroup
@@ -66,6 +101,33 @@ type Downloader struct {
 	lock      sync.RWMutex
 }
 
+// SyncProgress reports how far the current (or most recent) sync session
+// has gotten, for RPC exposure.
+type SyncProgress struct {
+	StartingBlock uint64
+	CurrentBlock  uint64
+	HighestBlock  uint64
+}
+
+// SyncProgress returns a snapshot of the downloader's progress.
+func (d *Downloader) SyncProgress() SyncProgress {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.progress
+}
+
+// InFlightBytes estimates how many bytes of fetched-but-unwritten header and
+// block data the current sync session is holding, for RPC/metrics exposure.
+func (d *Downloader) InFlightBytes() int64 {
+	d.lock.RLock()
+	tm := d.tm
+	d.lock.RUnlock()
+	if tm == nil {
+		return 0
+	}
+	return tm.store.InFlightBytes()
+}
+
 // NewDownloader create Downloader
 func NewDownloader(chain *core.Blockchain) *Downloader {
 	d := &Downloader{
@@ -77,8 +139,18 @@ func NewDownloader(chain *core.Blockchain) *Downloader {
 	return d
 }
 
-// Synchronise try to sync with remote peer.
-func (d *Downloader) Synchronise(id string, head common.Hash, td *big.Int, localTD *big.Int) error {
+// SetRequiredBlocks pins the block hash expected at each given height.
+// Synchronise refuses to sync against a master peer that disagrees with
+// any of them, letting an operator enforce known-good history (e.g. a
+// hard-coded checkpoint) without patching the code.
+func (d *Downloader) SetRequiredBlocks(required map[uint64]common.Hash) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.requiredBlocks = required
+}
+
+// Synchronise try to sync with remote peer using the given SyncMode.
+func (d *Downloader) Synchronise(id string, head common.Hash, td *big.Int, localTD *big.Int, mode SyncMode) error {
 	// Make sure only one routine can pass at once
 	d.lock.Lock()
 	if d.syncStatus != statusNone {
@@ -86,6 +158,7 @@ func (d *Downloader) Synchronise(id string, head common.Hash, td *big.Int, local
 		return errIsSynchronising
 	}
 	d.syncStatus = statusPreparing
+	d.syncMode = mode
 	d.cancelCh = make(chan struct{})
 	d.masterPeer = id
 	p, ok := d.peers[id]
@@ -101,6 +174,11 @@ func (d *Downloader) Synchronise(id string, head common.Hash, td *big.Int, local
 	d.lock.Lock()
 	d.syncStatus = statusNone
 	d.sessionWG.Wait()
+	// Always close cancelCh on the way out, even on success, so that any
+	// waitMsg callers still holding a reference to it (e.g. a peer that
+	// registered right as the session wound down) unblock instead of
+	// leaking until the next session overwrites d.cancelCh.
+	d.closeCancelChLocked()
 	d.cancelCh = nil
 	d.lock.Unlock()
 	return err
@@ -122,15 +200,36 @@ func (d *Downloader) doSynchronise(conn *peerConn, head common.Hash, td *big.Int
 	}
 	height := latest.Height
 
+	if err = d.verifyRequiredBlocks(conn, height); err != nil {
+		return err
+	}
+
 	ancestor, err := d.findCommonAncestorHeight(conn, height)
 	if err != nil {
 		return err
 	}
 	d.log.Debug("Downloader.findCommonAncestorHeight start, ancestor=%d", ancestor)
+
+	var pivot uint64
+	if d.syncMode == FastSync {
+		if pivot, err = d.pickPivot(ancestor, height); err != nil {
+			return err
+		}
+		d.log.Debug("Downloader.doSynchronise fast sync pivot=%d", pivot)
+	}
+
+	ancestorHash, err := d.chain.GetStore().GetBlockHash(ancestor)
+	if err != nil {
+		return err
+	}
+
 	tm := newTaskMgr(d, d.masterPeer, ancestor+1, height)
+	tm.pivot = pivot
+	tm.ancestorHash = ancestorHash
 	d.tm = tm
 	d.lock.Lock()
 	d.syncStatus = statusFetching
+	d.progress = SyncProgress{StartingBlock: ancestor + 1, CurrentBlock: ancestor, HighestBlock: height}
 	for _, c := range d.peers {
 		_, peerTD := c.peer.Head()
 		if localTD.Cmp(peerTD) >= 0 {
@@ -141,13 +240,26 @@ func (d *Downloader) doSynchronise(conn *peerConn, head common.Hash, td *big.Int
 		go d.peerDownload(c, tm)
 	}
 	d.lock.Unlock()
+
+	watchdogDone := make(chan struct{})
+	go d.watchPeers(tm, watchdogDone)
+
 	d.sessionWG.Wait()
+	close(watchdogDone)
 
 	d.lock.Lock()
 	d.syncStatus = statusCleaning
+	ss := d.ss
 	d.lock.Unlock()
+	if ss != nil {
+		ss.finish()
+		ss.wg.Wait()
+	}
 	tm.close()
+	d.lock.Lock()
 	d.tm = nil
+	d.ss = nil
+	d.lock.Unlock()
 	d.log.Info("downloader.doSynchronise quit!")
 
 	if tm.isDone() {
@@ -247,6 +359,56 @@ func (d *Downloader) findCommonAncestorHeight(conn *peerConn, height uint64) (ui
 	}
 }
 
+// verifyRequiredBlocks asks the candidate master peer directly for every
+// pinned checkpoint height at or below its advertised head, and fails the
+// session if any returned hash disagrees. This runs before the common
+// ancestor search so a peer on an eclipsed fork is rejected even if that
+// fork happens to share an ancestor with our local chain.
+func (d *Downloader) verifyRequiredBlocks(conn *peerConn, peerHeight uint64) error {
+	d.lock.RLock()
+	required := d.requiredBlocks
+	d.lock.RUnlock()
+
+	for height, wantHash := range required {
+		if height > peerHeight {
+			continue
+		}
+
+		if err := conn.peer.RequestHeadersByHashOrNumber(common.Hash{}, height, 1, false); err != nil {
+			return err
+		}
+		msg, err := conn.waitMsg(BlockHeadersMsg, d.cancelCh)
+		if err != nil {
+			return err
+		}
+
+		var headers []types.BlockHeader
+		if err := common.Deserialize(msg.Payload, &headers); err != nil {
+			return err
+		}
+		if len(headers) != 1 {
+			return errInvalidPacketRecved
+		}
+		if headers[0].Hash() != wantHash {
+			return errCheckpointMismatch
+		}
+	}
+	return nil
+}
+
+// pickPivot chooses the fast-sync pivot block: a recent block that is old
+// enough that its state is unlikely to be reorged away before it is fully
+// downloaded.
+func (d *Downloader) pickPivot(ancestor, height uint64) (uint64, error) {
+	if height <= ancestor {
+		return 0, errNoPivotBlock
+	}
+	if height-ancestor <= fastSyncPivotDistance {
+		return height, nil
+	}
+	return height - fastSyncPivotDistance, nil
+}
+
 // RegisterPeer add peer to download routine
 func (d *Downloader) RegisterPeer(peerID string, peer Peer) {
 	d.lock.Lock()
@@ -257,6 +419,11 @@ func (d *Downloader) RegisterPeer(peerID string, peer Peer) {
 	if d.syncStatus == statusFetching {
 		d.sessionWG.Add(1)
 		go d.peerDownload(newConn, d.tm)
+
+		if d.ss != nil {
+			d.ss.wg.Add(1)
+			go d.ss.run(newConn)
+		}
 	}
 }
 
@@ -286,6 +453,12 @@ func (d *Downloader) DeliverMsg(peerID string, msg *p2p.Message) {
 func (d *Downloader) Cancel() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	d.closeCancelChLocked()
+}
+
+// closeCancelChLocked closes d.cancelCh if it exists and isn't already
+// closed. Caller must hold d.lock.
+func (d *Downloader) closeCancelChLocked() {
 	if d.cancelCh != nil {
 		select {
 		case <-d.cancelCh:
@@ -295,6 +468,48 @@ func (d *Downloader) Cancel() {
 	}
 }
 
+// isMaster reports whether peerID is the current sync session's master peer.
+func (d *Downloader) isMaster(peerID string) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.masterPeer == peerID
+}
+
+// failoverMaster promotes the best remaining peer (by TD) to master after
+// the current master stalls or misbehaves, so the whole session doesn't
+// have to abort over one bad peer. Returns false if no candidate remains.
+func (d *Downloader) failoverMaster(failedPeerID string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.masterPeer != failedPeerID {
+		// Someone already failed over while we were deciding to.
+		return true
+	}
+
+	var bestID string
+	var bestTD *big.Int
+	for id, c := range d.peers {
+		if id == failedPeerID {
+			continue
+		}
+		_, td := c.peer.Head()
+		if bestTD == nil || td.Cmp(bestTD) > 0 {
+			bestID, bestTD = id, td
+		}
+	}
+	if bestID == "" {
+		return false
+	}
+
+	d.log.Info("downloader failing over master peer from %s to %s", failedPeerID, bestID)
+	d.masterPeer = bestID
+	if d.tm != nil {
+		d.tm.setMasterPeer(bestID)
+	}
+	return true
+}
+
 // Terminate close Downloader, cannot called anymore.
 func (d *Downloader) Terminate() {
 	d.Cancel()
@@ -302,74 +517,111 @@ func (d *Downloader) Terminate() {
 	// TODO release variables if needed
 }
 
+// fetchHeaders requests and delivers one header batch for conn, tracking it
+// as an outstanding request for the stall watchdog throughout. It returns
+// false if conn should be dropped from this session: a request/transport
+// error, a timeout, or an invalid response.
+func (d *Downloader) fetchHeaders(conn *peerConn, tm *taskMgr, peerID string, startNo uint64, amount int) bool {
+	d.log.Debug("tm.getReqHeaderInfo. %d %d", startNo, amount)
+	conn.beginRequest()
+	defer conn.endRequest()
+
+	reqStart := time.Now()
+	if err := conn.peer.RequestHeadersByHashOrNumber(common.Hash{}, startNo, amount, false); err != nil {
+		d.log.Info("RequestHeadersByHashOrNumber err!")
+		return false
+	}
+	msg, err := conn.waitMsg(BlockHeadersMsg, d.cancelCh)
+	if err != nil {
+		d.log.Info("peerDownload waitMsg BlockHeadersMsg err! %s", err)
+		conn.recordTimeout()
+		metrics.headerTimeouts.Add(1)
+		return false
+	}
+	var headers []*types.BlockHeader
+	if err := common.Deserialize(msg.Payload, &headers); err != nil {
+		d.log.Info("peerDownload Deserialize err! %s", err)
+		return false
+	}
+	conn.recordHeaders(len(headers), time.Since(reqStart))
+	metrics.headersReceived.Add(int64(len(headers)))
+
+	if err := tm.deliverHeaderMsg(peerID, headers); err != nil {
+		d.log.Info("peerDownload deliverHeaderMsg err! %s", err)
+		return false
+	}
+	return true
+}
+
+// fetchBlocks is fetchHeaders' counterpart for block bodies: it requests a
+// block range and waits for the BlocksPreMsg/BlocksMsg pair that delivers it.
+func (d *Downloader) fetchBlocks(conn *peerConn, tm *taskMgr, peerID string, startNo uint64, amount int) bool {
+	d.log.Debug("download.peerdown getReqBlocks startNo=%d amount=%d", startNo, amount)
+	conn.beginRequest()
+	defer conn.endRequest()
+
+	reqStart := time.Now()
+	if err := conn.peer.RequestBlocksByHashOrNumber(common.Hash{}, startNo, amount); err != nil {
+		d.log.Info("RequestBlocksByHashOrNumber err!")
+		return false
+	}
+
+	msg, err := conn.waitMsg(BlocksPreMsg, d.cancelCh)
+	if err != nil {
+		d.log.Info("peerDownload waitMsg BlocksPreMsg err! %s", err)
+		conn.recordTimeout()
+		metrics.blockTimeouts.Add(1)
+		return false
+	}
+
+	var blockNums []uint64
+	if err := common.Deserialize(msg.Payload, &blockNums); err != nil {
+		d.log.Info("peerDownload Deserialize err! %s", err)
+		return false
+	}
+	tm.deliverBlockPreMsg(peerID, blockNums)
+
+	msg, err = conn.waitMsg(BlocksMsg, d.cancelCh)
+	if err != nil {
+		d.log.Info("peerDownload waitMsg BlocksMsg err! %s", err)
+		conn.recordTimeout()
+		metrics.blockTimeouts.Add(1)
+		return false
+	}
+
+	var blocks []*types.Block
+	if err := common.Deserialize(msg.Payload, &blocks); err != nil {
+		d.log.Info("peerDownload Deserialize err! %s", err)
+		return false
+	}
+	conn.recordBlocks(len(blocks), time.Since(reqStart))
+	metrics.blocksReceived.Add(int64(len(blocks)))
+	tm.deliverBlockMsg(peerID, blocks)
+	return true
+}
+
 // peerDownload peer download routine
 func (d *Downloader) peerDownload(conn *peerConn, tm *taskMgr) {
 	defer d.sessionWG.Done()
 	d.log.Debug("Downloader.peerDownload start")
-	bMaster := (conn.peerID == d.masterPeer)
 	peerID := conn.peerID
-	var err error
 outLoop:
 	for !tm.isDone() {
 		hasReqData := false
 		if startNo, amount := tm.getReqHeaderInfo(conn); amount > 0 {
-			d.log.Debug("tm.getReqHeaderInfo. %d %d", startNo, amount)
 			hasReqData = true
-			if err = conn.peer.RequestHeadersByHashOrNumber(common.Hash{}, startNo, amount, false); err != nil {
-				d.log.Info("RequestHeadersByHashOrNumber err!")
-				break
-			}
-			msg, err := conn.waitMsg(BlockHeadersMsg, d.cancelCh)
-			if err != nil {
-				d.log.Info("peerDownload waitMsg BlockHeadersMsg err! %s", err)
-				break
-			}
-			var headers []*types.BlockHeader
-			if err = common.Deserialize(msg.Payload, &headers); err != nil {
-				d.log.Info("peerDownload Deserialize err! %s", err)
-				break
-			}
-
-			if err = tm.deliverHeaderMsg(peerID, headers); err != nil {
-				d.log.Info("peerDownload deliverHeaderMsg err! %s", err)
+			if !d.fetchHeaders(conn, tm, peerID, startNo, amount) {
 				break
 			}
 		}
 
 		if startNo, amount := tm.getReqBlocks(conn); amount > 0 {
-			d.log.Debug("download.peerdown getReqBlocks startNo=%d amount=%d", startNo, amount)
 			hasReqData = true
-			if err = conn.peer.RequestBlocksByHashOrNumber(common.Hash{}, startNo, amount); err != nil {
-				d.log.Info("RequestBlocksByHashOrNumber err!")
-				break
-			}
-
-			msg, err := conn.waitMsg(BlocksPreMsg, d.cancelCh)
-			if err != nil {
-				d.log.Info("peerDownload waitMsg BlocksPreMsg err! %s", err)
+			if !d.fetchBlocks(conn, tm, peerID, startNo, amount) {
 				break
 			}
-
-			var blockNums []uint64
-			if err = common.Deserialize(msg.Payload, &blockNums); err != nil {
-				d.log.Info("peerDownload Deserialize err! %s", err)
-				break
-			}
-			tm.deliverBlockPreMsg(peerID, blockNums)
-
-			msg, err = conn.waitMsg(BlocksMsg, d.cancelCh)
-			if err != nil {
-				d.log.Info("peerDownload waitMsg BlocksMsg err! %s", err)
-				break
-			}
-
-			var blocks []*types.Block
-			if err = common.Deserialize(msg.Payload, &blocks); err != nil {
-				d.log.Info("peerDownload Deserialize err! %s", err)
-				break
-			}
-			tm.deliverBlockMsg(peerID, blocks)
 		}
+
 		if hasReqData {
 			continue
 		}
@@ -389,26 +641,44 @@ outLoop:
 	}
 
 	tm.onPeerQuit(peerID)
-	if bMaster {
-		d.Cancel()
+	// Only a master stalling/misbehaving (loop broke out early, not
+	// because the session finished) warrants giving up its role; a
+	// non-master simply stops contributing.
+	if !tm.isDone() && d.isMaster(peerID) {
+		if !d.failoverMaster(peerID) {
+			d.Cancel()
+		}
 	}
 	d.log.Debug("Downloader.peerDownload end")
 }
 
-// processBlocks writes blocks to the blockchain.
+// processBlocks writes blocks to the blockchain. A head info whose block
+// body was never fetched (fast sync's pre-pivot range) is written
+// header-only instead.
 func (d *Downloader) processBlocks(headInfos []*masterHeadInfo) {
 
 	for _, h := range headInfos {
-		d.log.Debug("%d %s <- %s ", h.block.Header.Height, h.block.HeaderHash.ToHex(), h.block.Header.PreviousBlockHash.ToHex())
+		d.log.Debug("%d <- %d", h.height, h.header.PreviousBlockHash)
 	}
 
 	for _, h := range headInfos {
-		d.log.Debug("d.processBlock %d", h.block.Header.Height)
-		if err := d.chain.WriteBlock(h.block); err != nil && err != core.ErrBlockAlreadyExist {
+		var err error
+		if h.block != nil {
+			d.log.Debug("d.processBlock %d", h.height)
+			err = d.chain.WriteBlock(h.block)
+		} else {
+			d.log.Debug("d.processBlock %d (fast, header-only)", h.height)
+			err = d.chain.WriteHeader(h.header)
+		}
+		if err != nil && err != core.ErrBlockAlreadyExist {
 			d.log.Error("downloader processBlocks err. %s", err)
 			d.Cancel()
 			break
 		}
 		h.status = taskStatusProcessed
+
+		d.lock.Lock()
+		d.progress.CurrentBlock = h.height
+		d.lock.Unlock()
 	}
 }
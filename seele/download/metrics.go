@@ -0,0 +1,29 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import "sync/atomic"
+
+// counter is an atomically-updated int64 suitable for cheap per-request
+// metrics that something outside the package (an RPC handler, a Prometheus
+// exporter) can snapshot with Get.
+type counter int64
+
+func (c *counter) Add(delta int64) {
+	atomic.AddInt64((*int64)(c), delta)
+}
+
+func (c *counter) Get() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// metrics collects the downloader's request-level counters.
+var metrics = struct {
+	headersReceived counter
+	blocksReceived  counter
+	headerTimeouts  counter
+	blockTimeouts   counter
+}{}
@@ -0,0 +1,26 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"math/big"
+
+	"github.com/seeleteam/go-seele/common"
+)
+
+// Peer is the interface the downloader uses to talk to a remote node.
+// It is satisfied by the seeleprotocol peer implementation.
+type Peer interface {
+	Head() (common.Hash, *big.Int)
+	RequestHeadersByHashOrNumber(hash common.Hash, number uint64, amount int, reverse bool) error
+	RequestBlocksByHashOrNumber(hash common.Hash, number uint64, amount int) error
+	RequestStateData(nodeHashes []common.Hash) error
+
+	// SetBandwidth reports this peer's current smoothed estimate of headers
+	// and blocks per second (lowered after a timeout), so peer-selection logic outside the downloader
+	// (e.g. when choosing a new master peer) can prefer faster peers.
+	SetBandwidth(headersPerSec, blocksPerSec float64)
+}
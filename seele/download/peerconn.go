@@ -0,0 +1,152 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/seeleteam/go-seele/p2p"
+)
+
+var errPeerQuit = errors.New("peer connection is closing")
+
+// peerConn wraps a remote Peer together with the bookkeeping the downloader
+// needs to match asynchronous p2p responses back to the request that caused
+// them. Header/block fetching and state-node fetching run concurrently
+// against the same peer during fast sync, so waiters are keyed by message
+// code rather than sharing a single channel.
+type peerConn struct {
+	peer   Peer
+	peerID string
+
+	tp *throughput
+
+	bytesReceived int64 // atomic; total bytes delivered, for the stall watchdog
+
+	// reqActive/reqSentAt/reqBytesAtStart track the request this peer is
+	// currently answering, if any, so the watchdog can tell "no outstanding
+	// request" (idle because it has no assigned work) apart from "request
+	// outstanding with no progress" (actually stalled).
+	reqActive       int32 // atomic
+	reqSentAt       int64 // atomic; UnixNano when the current request was issued
+	reqBytesAtStart int64 // atomic; bytesReceived snapshot when it was issued
+
+	lock    sync.Mutex
+	waiters map[uint16]chan *p2p.Message
+
+	quitCh chan struct{}
+}
+
+func newPeerConn(peer Peer, peerID string) *peerConn {
+	return &peerConn{
+		peer:    peer,
+		peerID:  peerID,
+		tp:      newThroughput(),
+		waiters: make(map[uint16]chan *p2p.Message),
+		quitCh:  make(chan struct{}),
+	}
+}
+
+// waitMsg blocks until a message of the given code is delivered, the
+// download session is cancelled, the peer connection is closed, or
+// waitMsgTimeout elapses.
+func (pc *peerConn) waitMsg(code uint16, cancelCh chan struct{}) (*p2p.Message, error) {
+	ch := make(chan *p2p.Message, 1)
+	pc.lock.Lock()
+	pc.waiters[code] = ch
+	pc.lock.Unlock()
+	defer func() {
+		pc.lock.Lock()
+		delete(pc.waiters, code)
+		pc.lock.Unlock()
+	}()
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-cancelCh:
+		return nil, errSyncErr
+	case <-pc.quitCh:
+		return nil, errPeerQuit
+	case <-time.After(waitMsgTimeout):
+		return nil, errSyncErr
+	}
+}
+
+// deliverMsg hands a message received from the network over to whichever
+// routine is waiting for that message code, if any.
+func (pc *peerConn) deliverMsg(code uint16, msg *p2p.Message) {
+	atomic.AddInt64(&pc.bytesReceived, int64(len(msg.Payload)))
+
+	pc.lock.Lock()
+	ch, ok := pc.waiters[code]
+	pc.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// beginRequest marks this peer as having a request outstanding, for the
+// watchdog to measure progress against.
+func (pc *peerConn) beginRequest() {
+	atomic.StoreInt64(&pc.reqBytesAtStart, atomic.LoadInt64(&pc.bytesReceived))
+	atomic.StoreInt64(&pc.reqSentAt, time.Now().UnixNano())
+	atomic.StoreInt32(&pc.reqActive, 1)
+}
+
+// endRequest marks this peer as idle again, once its request has been
+// answered, errored, or timed out.
+func (pc *peerConn) endRequest() {
+	atomic.StoreInt32(&pc.reqActive, 0)
+}
+
+// hasStalled reports whether this peer has had a request outstanding for
+// longer than timeout with no bytes received since it was issued. A peer
+// with nothing outstanding (no assigned work, or throttled by backpressure)
+// never counts as stalled.
+func (pc *peerConn) hasStalled(timeout time.Duration) bool {
+	if atomic.LoadInt32(&pc.reqActive) == 0 {
+		return false
+	}
+	sentAt := atomic.LoadInt64(&pc.reqSentAt)
+	if time.Since(time.Unix(0, sentAt)) <= timeout {
+		return false
+	}
+	return atomic.LoadInt64(&pc.bytesReceived) <= atomic.LoadInt64(&pc.reqBytesAtStart)
+}
+
+// recordHeaders folds a completed header request into this peer's throughput estimate.
+func (pc *peerConn) recordHeaders(amount int, elapsed time.Duration) {
+	pc.tp.update(true, amount, elapsed)
+	pc.peer.SetBandwidth(pc.tp.rate(true), pc.tp.rate(false))
+}
+
+// recordBlocks is recordHeaders for block-body requests.
+func (pc *peerConn) recordBlocks(amount int, elapsed time.Duration) {
+	pc.tp.update(false, amount, elapsed)
+	pc.peer.SetBandwidth(pc.tp.rate(true), pc.tp.rate(false))
+}
+
+// recordTimeout penalises this peer's throughput after a request that got no response.
+func (pc *peerConn) recordTimeout() {
+	pc.tp.penalise()
+	pc.peer.SetBandwidth(pc.tp.rate(true), pc.tp.rate(false))
+}
+
+func (pc *peerConn) close() {
+	select {
+	case <-pc.quitCh:
+	default:
+		close(pc.quitCh)
+	}
+}
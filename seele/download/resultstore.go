@@ -0,0 +1,189 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/seeleteam/go-seele/core/types"
+)
+
+const (
+	// resultStoreCapacity bounds how many heights may be prepared but not
+	// yet written to the chain at once.
+	resultStoreCapacity = 4 * 1024
+
+	// commitBatchSize is how many contiguous ready heights are handed to
+	// the chain writer per commit, to amortise state-trie commits.
+	commitBatchSize = 64
+
+	estimatedHeaderBytes = 512
+	estimatedBlockBytes  = 8 * 1024
+)
+
+// resultStore assembles out-of-order header/block arrivals into the strictly
+// ascending order processBlocks needs, and reports when it is full so
+// fetching can back off.
+type resultStore struct {
+	from, to uint64
+
+	lock        sync.Mutex
+	items       map[uint64]*masterHeadInfo
+	writeCursor uint64 // next height to commit
+
+	// flushLock serializes commit end-to-end (build batch, write, advance
+	// the cursor) so two peers delivering blocks concurrently can't both
+	// build a batch off the same writeCursor and write it out of order.
+	flushLock sync.Mutex
+
+	inFlightBytes int64 // atomic
+}
+
+func newResultStore(from, to uint64) *resultStore {
+	return &resultStore{
+		from:        from,
+		to:          to,
+		items:       make(map[uint64]*masterHeadInfo),
+		writeCursor: from,
+	}
+}
+
+// isFull reports whether the store already holds resultStoreCapacity
+// heights' worth of unwritten work, i.e. fetching should pause.
+func (rs *resultStore) isFull() bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return uint64(len(rs.items)) >= resultStoreCapacity
+}
+
+// committedThrough reports whether every height up to and including `to`
+// has been written.
+func (rs *resultStore) committedThrough(to uint64) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.writeCursor > to
+}
+
+func (rs *resultStore) putHeader(h *masterHeadInfo) {
+	rs.lock.Lock()
+	rs.items[h.height] = h
+	rs.lock.Unlock()
+	atomic.AddInt64(&rs.inFlightBytes, estimatedHeaderBytes)
+}
+
+// putBlock attaches a fetched block body to a header previously claimed by
+// nextBlockRange, returning false if this height wasn't awaiting one.
+func (rs *resultStore) putBlock(height uint64, b *types.Block) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	h, ok := rs.items[height]
+	if !ok || h.status != taskStatusRequested {
+		return false
+	}
+	h.block = b
+	h.status = taskStatusFetched
+	h.requestedBy = ""
+	atomic.AddInt64(&rs.inFlightBytes, estimatedBlockBytes)
+	return true
+}
+
+// nextBlockRange finds the next contiguous run of prepared-but-bodyless
+// headers at or above minHeight, capped at max heights, and claims them for
+// peerID by bumping them to taskStatusRequested so a concurrent caller
+// doesn't hand the same range to a second peer. The claim is released by
+// releasePeerClaims if peerID quits before delivering.
+func (rs *resultStore) nextBlockRange(minHeight uint64, max int, peerID string) (uint64, int) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	var start uint64
+	var claimed []*masterHeadInfo
+	amount := 0
+	for h := rs.writeCursor; h <= rs.to; h++ {
+		item, ok := rs.items[h]
+		if !ok || item.status != taskStatusPrepared || h < minHeight {
+			if amount > 0 {
+				break
+			}
+			continue
+		}
+		if amount == 0 {
+			start = h
+		}
+		amount++
+		claimed = append(claimed, item)
+		if amount >= max {
+			break
+		}
+	}
+
+	for _, item := range claimed {
+		item.status = taskStatusRequested
+		item.requestedBy = peerID
+	}
+	return start, amount
+}
+
+// releasePeerClaims resets any block range claimed by peerID via
+// nextBlockRange but never delivered back to taskStatusPrepared, so another
+// peer can be given it.
+func (rs *resultStore) releasePeerClaims(peerID string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, item := range rs.items {
+		if item.status == taskStatusRequested && item.requestedBy == peerID {
+			item.status = taskStatusPrepared
+			item.requestedBy = ""
+		}
+	}
+}
+
+// commit hands off up to commitBatchSize contiguous ready heights, starting
+// at the write cursor, to write. ready reports whether a given height can be
+// committed yet, since fast sync's pivot needs different readiness criteria
+// than a normal block.
+func (rs *resultStore) commit(ready func(h *masterHeadInfo) bool, write func([]*masterHeadInfo)) {
+	rs.flushLock.Lock()
+	defer rs.flushLock.Unlock()
+
+	rs.lock.Lock()
+	batch := make([]*masterHeadInfo, 0, commitBatchSize)
+	cursor := rs.writeCursor
+	for cursor <= rs.to && len(batch) < commitBatchSize {
+		h, ok := rs.items[cursor]
+		if !ok || !ready(h) {
+			break
+		}
+		batch = append(batch, h)
+		cursor++
+	}
+	rs.lock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	write(batch)
+
+	var freed int64
+	rs.lock.Lock()
+	for _, h := range batch {
+		delete(rs.items, h.height)
+		freed += estimatedHeaderBytes
+		if h.block != nil {
+			freed += estimatedBlockBytes
+		}
+	}
+	rs.writeCursor = cursor
+	rs.lock.Unlock()
+	atomic.AddInt64(&rs.inFlightBytes, -freed)
+}
+
+// InFlightBytes estimates how many bytes of unwritten data the store holds.
+func (rs *resultStore) InFlightBytes() int64 {
+	return atomic.LoadInt64(&rs.inFlightBytes)
+}
@@ -0,0 +1,118 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"testing"
+
+	"github.com/seeleteam/go-seele/core/types"
+)
+
+func alwaysReady(*masterHeadInfo) bool { return true }
+
+func TestResultStoreCommitOrdersAndAdvancesCursor(t *testing.T) {
+	rs := newResultStore(1, 3)
+	for h := uint64(1); h <= 3; h++ {
+		rs.putHeader(&masterHeadInfo{height: h, status: taskStatusFetched})
+	}
+
+	var got []uint64
+	rs.commit(alwaysReady, func(batch []*masterHeadInfo) {
+		for _, h := range batch {
+			got = append(got, h.height)
+		}
+	})
+
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Fatalf("expected an ascending [1 2 3] batch, got %v", got)
+	}
+	if !rs.committedThrough(3) {
+		t.Fatalf("expected the store to report committed through 3")
+	}
+}
+
+func TestResultStoreCommitWaitsForOutOfOrderArrival(t *testing.T) {
+	rs := newResultStore(1, 3)
+	// Height 2 arrived but height 1 (the write cursor) never did.
+	rs.putHeader(&masterHeadInfo{height: 2, status: taskStatusFetched})
+
+	called := false
+	rs.commit(alwaysReady, func([]*masterHeadInfo) { called = true })
+
+	if called {
+		t.Fatalf("expected commit not to write past a gap at the write cursor")
+	}
+}
+
+func TestResultStoreNextBlockRangeRespectsMinHeight(t *testing.T) {
+	rs := newResultStore(1, 5)
+	for _, h := range []uint64{1, 2, 3, 4, 5} {
+		rs.putHeader(&masterHeadInfo{height: h, status: taskStatusPrepared})
+	}
+
+	start, amount := rs.nextBlockRange(3, 10, "peerA")
+	if start != 3 || amount != 3 {
+		t.Fatalf("expected range starting at the pivot (3,3), got (%d,%d)", start, amount)
+	}
+}
+
+func TestResultStoreNextBlockRangeClaimsAgainstConcurrentCallers(t *testing.T) {
+	rs := newResultStore(1, 5)
+	for _, h := range []uint64{1, 2, 3, 4, 5} {
+		rs.putHeader(&masterHeadInfo{height: h, status: taskStatusPrepared})
+	}
+
+	start, amount := rs.nextBlockRange(1, 3, "peerA")
+	if start != 1 || amount != 3 {
+		t.Fatalf("expected peerA to claim (1,3), got (%d,%d)", start, amount)
+	}
+
+	start, amount = rs.nextBlockRange(1, 3, "peerB")
+	if start != 4 || amount != 2 {
+		t.Fatalf("expected peerB to be handed the remainder (4,2) instead of peerA's claim, got (%d,%d)", start, amount)
+	}
+}
+
+func TestResultStoreReleasePeerClaimsFreesUndeliveredRange(t *testing.T) {
+	rs := newResultStore(1, 2)
+	rs.putHeader(&masterHeadInfo{height: 1, status: taskStatusPrepared})
+	rs.putHeader(&masterHeadInfo{height: 2, status: taskStatusPrepared})
+
+	rs.nextBlockRange(1, 2, "peerA")
+	rs.releasePeerClaims("peerA")
+
+	start, amount := rs.nextBlockRange(1, 2, "peerB")
+	if start != 1 || amount != 2 {
+		t.Fatalf("expected peerA's released claim to be available to peerB, got (%d,%d)", start, amount)
+	}
+}
+
+func TestResultStoreIsFullGatesOnCapacity(t *testing.T) {
+	rs := newResultStore(1, resultStoreCapacity+1)
+	for h := uint64(1); h <= resultStoreCapacity; h++ {
+		if rs.isFull() {
+			t.Fatalf("store reported full early at height %d", h)
+		}
+		rs.putHeader(&masterHeadInfo{height: h, status: taskStatusPrepared})
+	}
+	if !rs.isFull() {
+		t.Fatalf("expected store to report full at capacity")
+	}
+}
+
+func TestResultStoreInFlightBytesReturnsToZero(t *testing.T) {
+	rs := newResultStore(1, 2)
+	rs.putHeader(&masterHeadInfo{height: 1, status: taskStatusPrepared}) // header-only, never gets a block
+	rs.putHeader(&masterHeadInfo{height: 2, status: taskStatusPrepared})
+	rs.nextBlockRange(2, 1, "peerA") // claims height 2, the only bodyless-and-ready height
+	rs.putBlock(2, &types.Block{Header: &types.BlockHeader{Height: 2}})
+
+	rs.commit(alwaysReady, func([]*masterHeadInfo) {})
+
+	if got := rs.InFlightBytes(); got != 0 {
+		t.Fatalf("expected in-flight bytes to return to 0 once everything committed, got %d", got)
+	}
+}
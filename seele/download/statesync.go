@@ -0,0 +1,191 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/core/types"
+)
+
+// stateSync downloads a pivot block's world state trie, node by node, across
+// whichever peers are idle.
+type stateSync struct {
+	d      *Downloader
+	pivot  *types.BlockHeader
+	cancel chan struct{}
+
+	lock     sync.Mutex
+	queued   map[common.Hash]bool // hash -> already requested/received
+	pending  []common.Hash        // hashes not yet requested by any peer
+	received int
+	done     bool
+	err      error
+
+	wg sync.WaitGroup
+}
+
+// startStateSync begins downloading the pivot's state from every registered
+// peer. It is a no-op if a state sync is already running for this session.
+func (d *Downloader) startStateSync(pivot *types.BlockHeader) {
+	d.lock.Lock()
+	if d.ss != nil {
+		d.lock.Unlock()
+		return
+	}
+	ss := &stateSync{
+		d:      d,
+		pivot:  pivot,
+		cancel: make(chan struct{}),
+		queued: make(map[common.Hash]bool),
+	}
+	ss.queue(pivot.StateHash)
+	d.ss = ss
+	peers := make([]*peerConn, 0, len(d.peers))
+	for _, c := range d.peers {
+		peers = append(peers, c)
+	}
+	d.lock.Unlock()
+
+	for _, c := range peers {
+		ss.wg.Add(1)
+		go ss.run(c)
+	}
+}
+
+// getStateSync returns the session's current state sync, if any.
+func (d *Downloader) getStateSync() *stateSync {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.ss
+}
+
+func (ss *stateSync) queue(hash common.Hash) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.queued[hash] {
+		return
+	}
+	ss.queued[hash] = true
+	ss.pending = append(ss.pending, hash)
+}
+
+func (ss *stateSync) isDone() bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.done
+}
+
+// nextBatch pops up to MaxStateFetch pending trie node hashes, or nil.
+func (ss *stateSync) nextBatch() []common.Hash {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if len(ss.pending) == 0 {
+		return nil
+	}
+	amount := len(ss.pending)
+	if amount > MaxStateFetch {
+		amount = MaxStateFetch
+	}
+	batch := ss.pending[:amount]
+	ss.pending = ss.pending[amount:]
+	return batch
+}
+
+// run drives one peer's contribution until the trie is complete or cancelled.
+func (ss *stateSync) run(conn *peerConn) {
+	defer ss.wg.Done()
+	for {
+		if ss.isDone() {
+			return
+		}
+		batch := ss.nextBatch()
+		if len(batch) == 0 {
+			select {
+			case <-ss.cancel:
+				return
+			case <-conn.quitCh:
+				return
+			case <-time.After(peerIdleTime):
+				continue
+			}
+		}
+
+		if err := conn.peer.RequestStateData(batch); err != nil {
+			ss.requeue(batch)
+			return
+		}
+
+		msg, err := conn.waitMsg(StateDataMsg, ss.cancel)
+		if err != nil {
+			ss.requeue(batch)
+			return
+		}
+
+		var nodes [][]byte
+		if err := common.Deserialize(msg.Payload, &nodes); err != nil {
+			ss.requeue(batch)
+			return
+		}
+
+		ss.deliver(conn.peerID, batch, nodes)
+	}
+}
+
+func (ss *stateSync) requeue(hashes []common.Hash) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.pending = append(ss.pending, hashes...)
+}
+
+// deliver stores the received trie nodes and queues their children. A short
+// response requeues the unanswered hashes; a write failure aborts the
+// session, same as processBlocks does on a chain-write error.
+func (ss *stateSync) deliver(peerID string, requested []common.Hash, nodes [][]byte) {
+	for i, node := range nodes {
+		children, err := ss.d.chain.GetStore().WriteStateTrieNode(requested[i], node)
+		if err != nil {
+			ss.lock.Lock()
+			ss.err = err
+			ss.lock.Unlock()
+			ss.d.log.Error("stateSync deliver WriteStateTrieNode err. %s", err)
+			ss.d.Cancel()
+			return
+		}
+		for _, child := range children {
+			ss.queue(child)
+		}
+		ss.lock.Lock()
+		ss.received++
+		ss.lock.Unlock()
+	}
+
+	if len(nodes) < len(requested) {
+		ss.requeue(requested[len(nodes):])
+	}
+
+	ss.lock.Lock()
+	// Every queued hash is pending, in flight with some peer, or received;
+	// the trie is complete only once all of them have been received.
+	finished := len(ss.pending) == 0 && ss.received == len(ss.queued)
+	ss.lock.Unlock()
+	if finished {
+		ss.finish()
+	}
+}
+
+func (ss *stateSync) finish() {
+	ss.lock.Lock()
+	if ss.done {
+		ss.lock.Unlock()
+		return
+	}
+	ss.done = true
+	ss.lock.Unlock()
+	close(ss.cancel)
+}
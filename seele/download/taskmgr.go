@@ -0,0 +1,377 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"sync"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/core/types"
+)
+
+const (
+	taskStatusPrepared  = 1 // header known, block not fetched yet
+	taskStatusRequested = 2 // block range handed to a peer, awaiting delivery
+	taskStatusFetched   = 3 // block fetched, waiting to be written
+	taskStatusProcessed = 4 // block written to the chain
+)
+
+// skeletonStep is the spacing between skeleton anchors fetched up front by
+// the master peer; other peers fill in the headers between two anchors.
+var skeletonStep uint64 = 192
+
+// masterHeadInfo tracks one block height through the header/block/chain pipeline.
+type masterHeadInfo struct {
+	height uint64
+	header *types.BlockHeader
+	block  *types.Block
+	status int
+
+	// requestedBy is the peer a taskStatusRequested block range is claimed
+	// by, so the claim can be released if that peer quits before delivering.
+	requestedBy string
+}
+
+// headerSegment is the range between two consecutive skeleton anchors that
+// a peer fetches and validates by hash, filled by one or more sub-requests.
+type headerSegment struct {
+	start, end uint64 // inclusive; the headers at anchor[i]+1 .. anchor[i+1]
+
+	cursor          uint64      // next height within [start, end] still to fetch
+	runningPrevHash common.Hash // expected PreviousBlockHash of the header at `cursor`
+	anchorHash      common.Hash // expected Hash() of the header at `end`
+
+	assignedTo string
+	done       bool
+}
+
+// taskMgr hands out header/block ranges to idle peers and assembles the
+// results in height order.
+type taskMgr struct {
+	d          *Downloader
+	masterPeer string
+
+	from uint64 // first height that still needs work
+	to   uint64 // last height of the current session
+
+	// pivot is only set in FastSync mode: blocks below it are header-only,
+	// it is reconstructed from a downloaded world state, blocks above it
+	// are fetched and executed normally.
+	pivot uint64
+
+	lock sync.Mutex
+
+	// skeleton construction, built up as the master peer's anchor headers
+	// arrive; segments is populated once every anchor is known.
+	ancestorHash  common.Hash
+	anchorHeights []uint64
+	anchorHashes  map[uint64]common.Hash
+	nextAnchorIdx int
+	segments      []*headerSegment
+	skeletonDone  bool
+
+	store *resultStore // assembles fetched headers/blocks in height order
+	done  bool
+}
+
+func newTaskMgr(d *Downloader, masterPeer string, from, to uint64) *taskMgr {
+	tm := &taskMgr{
+		d:            d,
+		masterPeer:   masterPeer,
+		from:         from,
+		to:           to,
+		anchorHashes: make(map[uint64]common.Hash),
+		store:        newResultStore(from, to),
+	}
+
+	for h := from; h <= to; h += skeletonStep {
+		tm.anchorHeights = append(tm.anchorHeights, h)
+	}
+	if len(tm.anchorHeights) == 0 || tm.anchorHeights[len(tm.anchorHeights)-1] != to {
+		tm.anchorHeights = append(tm.anchorHeights, to)
+	}
+	return tm
+}
+
+func (tm *taskMgr) isDone() bool {
+	tm.lock.Lock()
+	done := tm.done
+	tm.lock.Unlock()
+	return done || tm.store.committedThrough(tm.to)
+}
+
+func (tm *taskMgr) close() {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.done = true
+}
+
+// setMasterPeer updates which peer the skeleton-anchor fetch is gated to,
+// called when failoverMaster promotes a new master mid-session.
+func (tm *taskMgr) setMasterPeer(peerID string) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.masterPeer = peerID
+}
+
+// getReqHeaderInfo returns the next header range this peer should fetch:
+// one anchor at a time from the master peer until the skeleton is complete,
+// then an unfilled segment sized to the peer's recent throughput. Like
+// getReqBlocks, this backs off once the result store is full: in FastSync,
+// pre-pivot headers are ready to commit the moment they arrive, but nothing
+// ever calls getReqBlocks for them, so header fetch must respect the same
+// backpressure or they would accumulate unbounded.
+func (tm *taskMgr) getReqHeaderInfo(conn *peerConn) (uint64, int) {
+	if tm.store.isFull() {
+		return 0, 0
+	}
+
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if !tm.skeletonDone {
+		if conn.peerID != tm.masterPeer {
+			return 0, 0
+		}
+		if tm.nextAnchorIdx >= len(tm.anchorHeights) {
+			return 0, 0
+		}
+		return tm.anchorHeights[tm.nextAnchorIdx], 1
+	}
+
+	for _, seg := range tm.segments {
+		if seg.done {
+			continue
+		}
+		if seg.assignedTo != "" && seg.assignedTo != conn.peerID {
+			continue
+		}
+		seg.assignedTo = conn.peerID
+
+		remaining := int(seg.end-seg.cursor) + 1
+		amount := conn.tp.headerAmount()
+		if amount > remaining {
+			amount = remaining
+		}
+		return seg.cursor, amount
+	}
+	return 0, 0
+}
+
+// buildSegments turns the now-complete skeleton into fetchable ranges
+// between consecutive anchors.
+func (tm *taskMgr) buildSegments() {
+	prevHeight := tm.from - 1
+	prevHash := tm.ancestorHash
+	for _, h := range tm.anchorHeights {
+		if h > prevHeight {
+			tm.segments = append(tm.segments, &headerSegment{
+				start:           prevHeight + 1,
+				end:             h,
+				cursor:          prevHeight + 1,
+				runningPrevHash: prevHash,
+				anchorHash:      tm.anchorHashes[h],
+			})
+		}
+		prevHeight = h
+		prevHash = tm.anchorHashes[h]
+	}
+	tm.skeletonDone = true
+}
+
+// getReqBlocks returns the next contiguous run of fetched-header-but-no-body
+// heights this peer should fetch, sized to that peer's recent throughput.
+// In FastSync mode, blocks below the pivot never need their bodies fetched
+// since they are inserted header-only. If the result store is already full
+// of unwritten work, this returns no work at all, which makes the caller
+// idle until processBlocks drains it — backpressure without a blocking call.
+func (tm *taskMgr) getReqBlocks(conn *peerConn) (uint64, int) {
+	if tm.store.isFull() {
+		return 0, 0
+	}
+
+	tm.lock.Lock()
+	minHeight := tm.pivot
+	tm.lock.Unlock()
+
+	return tm.store.nextBlockRange(minHeight, conn.tp.blockAmount(), conn.peerID)
+}
+
+// deliverHeaderMsg accepts a single skeleton-anchor header during the
+// skeleton phase, or a segment batch afterwards, validated by hash chain. A
+// segment batch triggers tryFlush afterwards, since FastSync's pre-pivot
+// headers are ready to commit as soon as they arrive, with no later
+// BlocksMsg to trigger it.
+func (tm *taskMgr) deliverHeaderMsg(peerID string, headers []*types.BlockHeader) error {
+	tm.lock.Lock()
+
+	if !tm.skeletonDone {
+		defer tm.lock.Unlock()
+		if peerID != tm.masterPeer || len(headers) != 1 {
+			return errInvalidPacketRecved
+		}
+		h := headers[0]
+		tm.anchorHashes[h.Height] = h.Hash()
+		tm.nextAnchorIdx++
+		if tm.nextAnchorIdx >= len(tm.anchorHeights) {
+			tm.buildSegments()
+		}
+		return nil
+	}
+
+	seg := tm.segmentFor(peerID, headers)
+	if seg == nil {
+		tm.lock.Unlock()
+		return errInvalidPacketRecved
+	}
+
+	prevHash, err := tm.validateSegmentBatch(seg, headers)
+	if err != nil {
+		// Empty, overrunning or mismatched batch: re-queue the whole segment
+		// for any peer to retry and free it up for reassignment.
+		seg.cursor = seg.start
+		seg.runningPrevHash = tm.segmentStartHash(seg)
+		seg.assignedTo = ""
+		tm.lock.Unlock()
+		return err
+	}
+
+	var pivotHeader *types.BlockHeader
+	for _, h := range headers {
+		tm.store.putHeader(&masterHeadInfo{
+			height: h.Height,
+			header: h,
+			status: taskStatusPrepared,
+		})
+
+		if tm.pivot > 0 && h.Height == tm.pivot {
+			pivotHeader = h
+		}
+	}
+
+	seg.cursor += uint64(len(headers))
+	seg.runningPrevHash = prevHash
+	if seg.cursor > seg.end {
+		if prevHash != seg.anchorHash {
+			seg.cursor = seg.start
+			seg.runningPrevHash = tm.segmentStartHash(seg)
+			seg.assignedTo = ""
+			tm.lock.Unlock()
+			return errInvalidAncestor
+		}
+		seg.done = true
+	}
+	tm.lock.Unlock()
+
+	// startStateSync takes d.lock; called with tm.lock already released so
+	// this can never invert against failoverMaster's d.lock -> tm.lock order.
+	if pivotHeader != nil {
+		tm.d.startStateSync(pivotHeader)
+	}
+
+	tm.tryFlush()
+	return nil
+}
+
+// segmentFor finds the in-flight segment this peer was handed, matched by
+// the height of the first returned header.
+func (tm *taskMgr) segmentFor(peerID string, headers []*types.BlockHeader) *headerSegment {
+	if len(headers) == 0 {
+		return nil
+	}
+	start := headers[0].Height
+	for _, seg := range tm.segments {
+		if seg.cursor == start && seg.assignedTo == peerID && !seg.done {
+			return seg
+		}
+	}
+	return nil
+}
+
+// segmentStartHash recovers the PreviousBlockHash the very first header of
+// a segment must have, for use when re-queuing it after a bad batch.
+func (tm *taskMgr) segmentStartHash(seg *headerSegment) common.Hash {
+	if seg.start == tm.from {
+		return tm.ancestorHash
+	}
+	return tm.anchorHashes[seg.start-1]
+}
+
+// validateSegmentBatch checks a sub-batch chains from the segment's cursor,
+// returning the hash of its last header, or an error if it is empty, runs past
+// the segment's end, or breaks the chain. A non-empty batch with fewer headers
+// than were requested is accepted as partial progress.
+func (tm *taskMgr) validateSegmentBatch(seg *headerSegment, headers []*types.BlockHeader) (common.Hash, error) {
+	if len(headers) == 0 || seg.cursor+uint64(len(headers))-1 > seg.end {
+		return common.Hash{}, errInvalidPacketRecved
+	}
+
+	prevHash := seg.runningPrevHash
+	for i, h := range headers {
+		if h.Height != seg.cursor+uint64(i) || h.PreviousBlockHash != prevHash {
+			return common.Hash{}, errInvalidAncestor
+		}
+		prevHash = h.Hash()
+	}
+	return prevHash, nil
+}
+
+func (tm *taskMgr) deliverBlockPreMsg(peerID string, blockNums []uint64) {
+	// Reserved for matching up the follow-on BlocksMsg; nothing to do yet.
+}
+
+func (tm *taskMgr) deliverBlockMsg(peerID string, blocks []*types.Block) {
+	for _, b := range blocks {
+		tm.store.putBlock(b.Header.Height, b)
+	}
+
+	tm.tryFlush()
+}
+
+// tryFlush hands every contiguous run of ready heights, starting at the
+// store's write cursor, to the chain writer in batches. A "fast" block
+// (below the fast-sync pivot) is ready as soon as its header has arrived;
+// it is written header-only. The pivot itself only becomes ready once its
+// world state has finished downloading.
+func (tm *taskMgr) tryFlush() {
+	tm.lock.Lock()
+	pivot := tm.pivot
+	tm.lock.Unlock()
+
+	ready := func(h *masterHeadInfo) bool {
+		if pivot > 0 && h.height < pivot {
+			return true
+		}
+		if pivot > 0 && h.height == pivot {
+			ss := tm.d.getStateSync()
+			return ss != nil && ss.isDone()
+		}
+		return h.status == taskStatusFetched
+	}
+
+	tm.store.commit(ready, tm.d.processBlocks)
+
+	if tm.store.committedThrough(tm.to) {
+		tm.lock.Lock()
+		tm.done = true
+		tm.lock.Unlock()
+	}
+}
+
+func (tm *taskMgr) onPeerQuit(peerID string) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	for _, seg := range tm.segments {
+		if seg.assignedTo == peerID && !seg.done {
+			seg.assignedTo = ""
+			seg.cursor = seg.start
+			seg.runningPrevHash = tm.segmentStartHash(seg)
+		}
+	}
+
+	tm.store.releasePeerClaims(peerID)
+}
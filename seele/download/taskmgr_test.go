@@ -0,0 +1,86 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"testing"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/core/types"
+)
+
+func chainedHeaders(start uint64, prevHash common.Hash, n int) []*types.BlockHeader {
+	headers := make([]*types.BlockHeader, n)
+	for i := 0; i < n; i++ {
+		h := &types.BlockHeader{
+			Height:            start + uint64(i),
+			PreviousBlockHash: prevHash,
+		}
+		headers[i] = h
+		prevHash = h.Hash()
+	}
+	return headers
+}
+
+func TestValidateSegmentBatchAccepts(t *testing.T) {
+	tm := &taskMgr{}
+	seg := &headerSegment{start: 10, end: 14, cursor: 10, runningPrevHash: common.Hash{}}
+
+	headers := chainedHeaders(10, seg.runningPrevHash, 3)
+	prevHash, err := tm.validateSegmentBatch(seg, headers)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if prevHash != headers[2].Hash() {
+		t.Fatalf("expected prevHash to be the last header's hash")
+	}
+}
+
+func TestValidateSegmentBatchRejectsHashMismatch(t *testing.T) {
+	tm := &taskMgr{}
+	seg := &headerSegment{start: 10, end: 14, cursor: 10, runningPrevHash: common.Hash{}}
+
+	headers := chainedHeaders(10, seg.runningPrevHash, 2)
+	headers[1].PreviousBlockHash = common.Hash{0x1} // breaks the chain
+
+	if _, err := tm.validateSegmentBatch(seg, headers); err != errInvalidAncestor {
+		t.Fatalf("expected errInvalidAncestor, got %v", err)
+	}
+}
+
+func TestValidateSegmentBatchRejectsOverrun(t *testing.T) {
+	tm := &taskMgr{}
+	seg := &headerSegment{start: 10, end: 11, cursor: 10, runningPrevHash: common.Hash{}}
+
+	headers := chainedHeaders(10, seg.runningPrevHash, 3) // runs past seg.end
+	if _, err := tm.validateSegmentBatch(seg, headers); err != errInvalidPacketRecved {
+		t.Fatalf("expected errInvalidPacketRecved, got %v", err)
+	}
+}
+
+func TestSegmentForMatchesCursorAndAssignedPeer(t *testing.T) {
+	seg := &headerSegment{start: 10, end: 20, cursor: 12, assignedTo: "peerA"}
+	tm := &taskMgr{segments: []*headerSegment{seg}}
+
+	headers := []*types.BlockHeader{{Height: 12}}
+	if got := tm.segmentFor("peerA", headers); got != seg {
+		t.Fatalf("expected to find segment for the assigned peer")
+	}
+	if got := tm.segmentFor("peerB", headers); got != nil {
+		t.Fatalf("expected no match for a different peer")
+	}
+}
+
+func TestOnPeerQuitRequeuesAssignedSegment(t *testing.T) {
+	seg := &headerSegment{start: 10, end: 20, cursor: 15, assignedTo: "peerA", runningPrevHash: common.Hash{0x9}}
+	tm := &taskMgr{from: 10, ancestorHash: common.Hash{0x1}, segments: []*headerSegment{seg}, store: newResultStore(10, 20)}
+
+	tm.onPeerQuit("peerA")
+
+	if seg.assignedTo != "" || seg.cursor != seg.start || seg.runningPrevHash != tm.ancestorHash {
+		t.Fatalf("expected segment to be reset for reassignment, got %+v", seg)
+	}
+}
@@ -0,0 +1,96 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// targetRoundTrip is the response time taskMgr scales each peer's requests towards.
+const targetRoundTrip = 5 * time.Second
+
+// emaAlpha weights how quickly the moving averages below react to a new sample.
+const emaAlpha = 0.3
+
+// throughput tracks how fast a peer answers header/block requests so
+// taskMgr can size its next request accordingly.
+type throughput struct {
+	lock sync.Mutex
+
+	headersPerSec float64
+	blocksPerSec  float64
+	rtt           time.Duration
+
+	idleStreak int // consecutive penalties since the last successful sample
+}
+
+func newThroughput() *throughput {
+	return &throughput{
+		headersPerSec: float64(MaxHeaderFetch) / targetRoundTrip.Seconds(),
+		blocksPerSec:  float64(MaxBlockFetch) / targetRoundTrip.Seconds(),
+		rtt:           targetRoundTrip,
+	}
+}
+
+// update folds in one more (amount, elapsed) sample via an exponential
+// moving average, and clears the idle penalty.
+func (t *throughput) update(isHeaders bool, amount int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	rate := float64(amount) / elapsed.Seconds()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if isHeaders {
+		t.headersPerSec = emaAlpha*rate + (1-emaAlpha)*t.headersPerSec
+	} else {
+		t.blocksPerSec = emaAlpha*rate + (1-emaAlpha)*t.blocksPerSec
+	}
+	t.rtt = time.Duration(emaAlpha*float64(elapsed) + (1-emaAlpha)*float64(t.rtt))
+	t.idleStreak = 0
+}
+
+// penalise halves the peer's estimated throughput after a timeout or error.
+func (t *throughput) penalise() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.headersPerSec /= 2
+	t.blocksPerSec /= 2
+	t.idleStreak++
+}
+
+// headerAmount returns how many headers to request next, scaled so the
+// response should take roughly targetRoundTrip, clamped to [floor, Max].
+func (t *throughput) headerAmount() int {
+	return scale(t.rate(true), minHeaderFetch, MaxHeaderFetch)
+}
+
+// blockAmount is headerAmount's counterpart for block-body requests.
+func (t *throughput) blockAmount() int {
+	return scale(t.rate(false), minBlockFetch, MaxBlockFetch)
+}
+
+func (t *throughput) rate(isHeaders bool) float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if isHeaders {
+		return t.headersPerSec
+	}
+	return t.blocksPerSec
+}
+
+func scale(perSec float64, floor, ceil int) int {
+	amount := int(perSec * targetRoundTrip.Seconds())
+	if amount < floor {
+		return floor
+	}
+	if amount > ceil {
+		return ceil
+	}
+	return amount
+}
@@ -0,0 +1,51 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import "testing"
+
+func TestThroughputUpdateMovesTowardsNewSample(t *testing.T) {
+	tp := newThroughput()
+	before := tp.rate(true)
+
+	tp.update(true, MaxHeaderFetch, targetRoundTrip/2) // twice the starting rate
+	after := tp.rate(true)
+
+	if after <= before {
+		t.Fatalf("expected the header rate to move up towards a faster sample, got %f from %f", after, before)
+	}
+	if tp.idleStreak != 0 {
+		t.Fatalf("expected idleStreak to reset after a successful update")
+	}
+}
+
+func TestThroughputPenaliseHalvesRateAndTracksStreak(t *testing.T) {
+	tp := newThroughput()
+	before := tp.rate(false)
+
+	tp.penalise()
+	if got := tp.rate(false); got != before/2 {
+		t.Fatalf("expected blocksPerSec to halve, got %f want %f", got, before/2)
+	}
+	tp.penalise()
+	if tp.idleStreak != 2 {
+		t.Fatalf("expected idleStreak to accumulate, got %d", tp.idleStreak)
+	}
+}
+
+func TestScaleClampsToFloorAndCeiling(t *testing.T) {
+	if got := scale(0, 10, 100); got != 10 {
+		t.Fatalf("expected scale to clamp to floor, got %d", got)
+	}
+	if got := scale(1e9, 10, 100); got != 100 {
+		t.Fatalf("expected scale to clamp to ceiling, got %d", got)
+	}
+
+	perSec := 20.0 / targetRoundTrip.Seconds()
+	if got := scale(perSec, 1, 1000); got != 20 {
+		t.Fatalf("expected scale to size to roughly one round trip, got %d", got)
+	}
+}
@@ -0,0 +1,51 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package downloader
+
+import "time"
+
+const (
+	watchdogInterval = 2 * time.Second  // how often the watchdog samples peer progress
+	stallTimeout     = 20 * time.Second // how long a peer may go without forward progress before being dropped
+)
+
+// watchPeers drops any peer that has had a request outstanding for longer
+// than stallTimeout with no bytes delivered against it, for the lifetime of
+// one sync session. A peer with nothing currently assigned - throttled by
+// result-store backpressure, or simply not yet given skeleton work - is
+// never considered stalled; see peerConn.hasStalled.
+func (d *Downloader) watchPeers(tm *taskMgr, done <-chan struct{}) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-d.cancelCh:
+			return
+		case <-ticker.C:
+			d.lock.RLock()
+			conns := make([]*peerConn, 0, len(d.peers))
+			for _, c := range d.peers {
+				conns = append(conns, c)
+			}
+			d.lock.RUnlock()
+
+			for _, c := range conns {
+				if !c.hasStalled(stallTimeout) {
+					continue
+				}
+				d.log.Info("downloader watchdog dropping stalled peer %s", c.peerID)
+				d.UnRegisterPeer(c.peerID)
+			}
+
+			if tm.isDone() {
+				return
+			}
+		}
+	}
+}